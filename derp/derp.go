@@ -0,0 +1,137 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package derp implements the Designated Encrypted Relay for Packets
+// protocol.
+//
+// DERP relays packets between clients identified by their public key,
+// for use when a direct path can't be established between two Tailscale
+// nodes.
+package derp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// frameType is the one-byte type of a DERP frame.
+type frameType byte
+
+const (
+	// 0 is reserved and never sent.
+	frameServerKey     = frameType(0x01) // 32B server curve25519 public key + 32B server Ed25519 signing key
+	frameClientInfo    = frameType(0x02) // 32B client curve25519 public key + 32B client Ed25519 signing key
+	frameServerInfo    = frameType(0x03) // box(json)
+	frameSendPacket    = frameType(0x04) // 32B dest pub key + packet bytes
+	frameRecvPacket    = frameType(0x05) // 32B src pub key + packet bytes
+	frameKeepAlive     = frameType(0x06) // no payload; sent by server to client to keep connection alive
+	frameNotePreferred = frameType(0x07) // 1B byte bool; whether this is client's home server
+	framePeerGone      = frameType(0x08) // 32B peer public key of disconnected peer
+	framePeerPresent   = frameType(0x09) // 32B peer public key of a peer that's here
+	frameForwardPacket = frameType(0x0a) // 32B src pub key + 32B dst pub key + packet bytes (server only)
+
+	// frameHandshakeHello and frameHandshakeAuth implement the optional
+	// noise-style encryption handshake; see derp_noise.go.
+	frameHandshakeHello = frameType(0x0b) // 32B ephemeral curve25519 public key
+	frameHandshakeAuth  = frameType(0x0c) // 64B Ed25519 signature over the handshake challenge
+
+	// frameSealed wraps a frame once encryption is enabled: 8B
+	// monotonic nonce counter + ChaCha20-Poly1305 seal of (1B inner
+	// frame type + inner frame payload). See derp_noise.go.
+	frameSealed = frameType(0x0d)
+
+	// frameControlReq and frameControlResp implement request/response
+	// correlation for control frames on top of the otherwise async frame
+	// stream; see Client.Call in derp_call.go.
+	frameControlReq  = frameType(0x0e) // 8B request ID + 1B wrapped frameType + payload
+	frameControlResp = frameType(0x0f) // 8B request ID + payload
+)
+
+// maxFrameSize is the max frame size, to avoid peers from crashing each other
+// with unreasonable memory allocations.
+const maxFrameSize = 10 << 20
+
+// MaxPacketSize is the maximum size of a packet that can be sent through
+// the DERP server.
+const MaxPacketSize = 64 << 10
+
+// keyLen is the length in bytes of a curve25519 public or private key, as
+// used in key.Public and key.Private.
+const keyLen = 32
+
+var errBigPacket = errors.New("derp: packet too big")
+
+// writeFrameHeader writes the frame header (type + length) to bw.
+func writeFrameHeader(bw *bufio.Writer, t frameType, frameLen uint32) error {
+	if err := bw.WriteByte(byte(t)); err != nil {
+		return err
+	}
+	var b4 [4]byte
+	binary.BigEndian.PutUint32(b4[:], frameLen)
+	_, err := bw.Write(b4[:])
+	return err
+}
+
+// writeFrame writes a complete frame, header plus the given byte slices
+// concatenated, and flushes bw.
+func writeFrame(bw *bufio.Writer, t frameType, b ...[]byte) error {
+	var total int
+	for _, bb := range b {
+		total += len(bb)
+	}
+	if total > maxFrameSize {
+		return errBigPacket
+	}
+	if err := writeFrameHeader(bw, t, uint32(total)); err != nil {
+		return err
+	}
+	for _, bb := range b {
+		if _, err := bw.Write(bb); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// readFrameHeader reads a frame header from br, returning its type and
+// declared length. It does not read the frame body.
+func readFrameHeader(br *bufio.Reader) (t frameType, frameLen uint32, err error) {
+	tb, err := br.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	var b4 [4]byte
+	if _, err := io.ReadFull(br, b4[:]); err != nil {
+		return 0, 0, err
+	}
+	frameLen = binary.BigEndian.Uint32(b4[:])
+	if frameLen > maxFrameSize {
+		return 0, 0, fmt.Errorf("derp: frame length %d exceeds max %d", frameLen, maxFrameSize)
+	}
+	return frameType(tb), frameLen, nil
+}
+
+// readFrame reads a frame of the expected maximum size into b, returning
+// the frame's type and the number of bytes read into b. If the actual
+// frame is larger than maxSize, its body is discarded from br rather
+// than read into b.
+func readFrame(br *bufio.Reader, maxSize uint32, b []byte) (t frameType, n int, err error) {
+	t, frameLen, err := readFrameHeader(br)
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameLen > maxSize {
+		if _, err := io.CopyN(io.Discard, br, int64(frameLen)); err != nil {
+			return 0, 0, err
+		}
+		return t, 0, fmt.Errorf("derp: frame length %d exceeds max %d", frameLen, maxSize)
+	}
+	if _, err := io.ReadFull(br, b[:frameLen]); err != nil {
+		return 0, 0, err
+	}
+	return t, int(frameLen), nil
+}
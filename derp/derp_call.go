@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// callResult is delivered to a pending Call once its frameControlResp
+// arrives.
+type callResult struct {
+	payload []byte
+	err     error
+}
+
+// callIDLen is the length in bytes of a Call's request ID, as carried in
+// frameControlReq and frameControlResp.
+const callIDLen = 8
+
+// Call issues a control frame of the given kind to the server and waits
+// for the matching response, correlated by a request ID that Call
+// allocates. It's meant for request/response-shaped control traffic
+// (liveness probes, metadata queries) that doesn't fit naturally into
+// Recv's async stream of packets and server notifications.
+//
+// Call only completes once some goroutine is blocked in Recv to read the
+// response frame off the wire and dispatch it; a Client with no Recv
+// loop running will have every Call hang until ctx is done.
+func (c *Client) Call(ctx context.Context, kind frameType, payload []byte) ([]byte, error) {
+	id := atomic.AddUint64(&c.nextCallID, 1)
+	ch := make(chan callResult, 1)
+
+	c.callMu.Lock()
+	if c.calls == nil {
+		c.calls = make(map[uint64]chan callResult)
+	}
+	c.calls[id] = ch
+	c.callMu.Unlock()
+	defer func() {
+		c.callMu.Lock()
+		delete(c.calls, id)
+		c.callMu.Unlock()
+	}()
+
+	var idBuf [callIDLen]byte
+	binary.BigEndian.PutUint64(idBuf[:], id)
+
+	c.wmu.Lock()
+	err := c.writeFrame(frameControlReq, idBuf[:], []byte{byte(kind)}, payload)
+	c.wmu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("derp: sending call: %w", err)
+	}
+
+	select {
+	case res := <-ch:
+		return res.payload, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dispatchControlResp delivers an incoming frameControlResp payload b to
+// its matching pending Call, if any. It's called from Recv's read loop,
+// the same goroutine that reads every other frame, so a slow or absent
+// Call doesn't block subsequent frames: deliveries are non-blocking into
+// a buffered channel only Call itself reads from.
+func (c *Client) dispatchControlResp(b []byte) {
+	if len(b) < callIDLen {
+		return
+	}
+	id := binary.BigEndian.Uint64(b[:callIDLen])
+	c.callMu.Lock()
+	ch := c.calls[id]
+	c.callMu.Unlock()
+	if ch == nil {
+		return // no one's waiting (timed out, or an unsolicited/duplicate response)
+	}
+	payload := append([]byte(nil), b[callIDLen:]...)
+	select {
+	case ch <- callResult{payload: payload}:
+	default:
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// Client is a DERP client. It connects to a DERP server to relay packets
+// to and from other clients, identified by their public key.
+//
+// Client is not safe for concurrent use by multiple goroutines, except
+// that Send, Recv, Call, and NotePreferred may each be called
+// concurrently with one another.
+type Client struct {
+	privateKey key.Private
+	publicKey  key.Public
+	conn       net.Conn
+	logf       logger.Logf
+
+	// serverKey and serverSigningKey are the server's long-term
+	// identity, learned from its frameServerKey frame during NewClient.
+	serverKey        key.Public
+	serverSigningKey key.SigningPublic
+
+	wmu sync.Mutex // guards writes to bw
+	bw  *bufio.Writer
+
+	br *bufio.Reader
+
+	// enc, once set by EnableEncryption, seals every frame this Client
+	// writes and unseals every frame it reads. It's never reassigned
+	// afterward, so it's safe to read without a lock.
+	enc *frameCipher
+
+	// nextCallID is the source of request IDs for Call; see derp_call.go.
+	nextCallID uint64 // atomic
+
+	callMu sync.Mutex
+	calls  map[uint64]chan callResult
+}
+
+// NewClient returns a new DERP client, using privateKey as its identity
+// and nc as its already-dialed connection to a DERP server. brw is an
+// already-constructed bufio.ReadWriter wrapping nc, reused so callers can
+// insert additional buffering or inspect pre-read bytes before handing
+// the connection to the client.
+func NewClient(privateKey key.Private, nc net.Conn, brw *bufio.ReadWriter, logf logger.Logf) (*Client, error) {
+	c := &Client{
+		privateKey: privateKey,
+		publicKey:  privateKey.Public(),
+		conn:       nc,
+		logf:       logf,
+		br:         brw.Reader,
+		bw:         brw.Writer,
+	}
+	serverKey, serverSigningKey, err := readServerKey(c.br)
+	if err != nil {
+		return nil, fmt.Errorf("derp.Client: reading server key: %w", err)
+	}
+	c.serverKey = serverKey
+	c.serverSigningKey = serverSigningKey
+	if err := c.sendClientKey(); err != nil {
+		return nil, fmt.Errorf("derp.Client: failed to send client key: %w", err)
+	}
+	return c, nil
+}
+
+// ServerPublicKey returns the server's long-term curve25519 identity, as
+// presented in its frameServerKey frame during NewClient. It's exported
+// so a caller that already knows which key to expect (e.g. from prior
+// out-of-band configuration) can pin against it before trusting the
+// connection; nothing here checks it automatically, since the server's
+// identity is otherwise self-asserted over the same wire an attacker
+// controls. See the doc comment at the top of derp_noise.go.
+func (c *Client) ServerPublicKey() key.Public { return c.serverKey }
+
+// ServerSigningKey returns the server's long-term Ed25519 identity, used
+// to authenticate it during EnableEncryption. See ServerPublicKey.
+func (c *Client) ServerSigningKey() key.SigningPublic { return c.serverSigningKey }
+
+// readServerKey reads the server's frameServerKey handshake frame,
+// which carries both its curve25519 identity (used to exchange
+// ephemeral keys) and its Ed25519 signing identity (used to
+// authenticate itself in EnableEncryption).
+func readServerKey(br *bufio.Reader) (pub key.Public, signingPub key.SigningPublic, err error) {
+	buf := make([]byte, 2*keyLen)
+	t, n, err := readFrame(br, uint32(len(buf)), buf)
+	if err != nil {
+		return pub, signingPub, err
+	}
+	if t != frameServerKey || n != len(buf) {
+		return pub, signingPub, fmt.Errorf("unexpected server key frame (type %v, %d bytes)", t, n)
+	}
+	copy(pub[:], buf[:keyLen])
+	copy(signingPub[:], buf[keyLen:])
+	return pub, signingPub, nil
+}
+
+func (c *Client) sendClientKey() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	signingPub := c.privateKey.SigningPublic()
+	return writeFrame(c.bw, frameClientInfo, c.publicKey[:], signingPub[:])
+}
+
+// ReceivedPacket is a message that a peer sent us through the DERP server.
+type ReceivedPacket struct {
+	Source key.Public
+	// Data is the received packet bytes. It aliases the byte slice
+	// passed to Client.Recv and is invalidated by the next call to Recv.
+	Data []byte
+}
+
+// PeerGoneMessage is sent by the server to notify the client that a
+// previous sender is no longer connected, so the client should not keep
+// trying to reply to it.
+type PeerGoneMessage key.Public
+
+// PeerPresentMessage is sent by the server to notify the client that a
+// peer has sent a packet to the server and is connected.
+type PeerPresentMessage key.Public
+
+// Send sends a packet to the peer identified by dstKey.
+//
+// It is an error if the packet is larger than MaxPacketSize.
+func (c *Client) Send(dstKey key.Public, pkt []byte) error {
+	if len(pkt) > MaxPacketSize {
+		return errBigPacket
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeFrame(frameSendPacket, dstKey[:], pkt)
+}
+
+// SendContext is like Send but respects ctx's deadline and cancellation,
+// so a caller can give up on a slow or stuck peer without tearing down
+// the whole Client.
+func (c *Client) SendContext(ctx context.Context, dstKey key.Public, pkt []byte) error {
+	if len(pkt) > MaxPacketSize {
+		return errBigPacket
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	stop := armDeadline(ctx, c.conn.SetWriteDeadline)
+	defer stop()
+	return ctxErr(ctx, c.writeFrame(frameSendPacket, dstKey[:], pkt))
+}
+
+// NotePreferred sends a message to the server to let it know whether
+// this client considers itself the client's preferred (home) DERP server.
+func (c *Client) NotePreferred(preferred bool) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var b [1]byte
+	if preferred {
+		b[0] = 1
+	}
+	if err := c.writeFrame(frameNotePreferred, b[:]); err != nil {
+		c.logf("derp.Client.NotePreferred: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Recv reads a message from the server. The returned message may alias
+// the given buffer b. The dynamic type of the returned message is one of
+// ReceivedPacket, PeerGoneMessage, or PeerPresentMessage.
+func (c *Client) Recv(b []byte) (m interface{}, err error) {
+	for {
+		t, n, err := c.readFrame(b)
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case frameKeepAlive:
+			continue
+		case frameNotePreferred, frameServerInfo:
+			continue
+		case frameControlResp:
+			c.dispatchControlResp(b[:n])
+			continue
+		case framePeerGone:
+			if n < keyLen {
+				continue
+			}
+			var pk key.Public
+			copy(pk[:], b[:keyLen])
+			return PeerGoneMessage(pk), nil
+		case framePeerPresent:
+			if n < keyLen {
+				continue
+			}
+			var pk key.Public
+			copy(pk[:], b[:keyLen])
+			return PeerPresentMessage(pk), nil
+		case frameRecvPacket:
+			if n < keyLen {
+				continue
+			}
+			var pk key.Public
+			copy(pk[:], b[:keyLen])
+			return ReceivedPacket{Source: pk, Data: b[keyLen:n]}, nil
+		default:
+			continue
+		}
+	}
+}
+
+// RecvContext is like Recv but respects ctx's deadline and cancellation,
+// so a caller can abandon a Recv that's blocked waiting on a relay that
+// has gone quiet.
+func (c *Client) RecvContext(ctx context.Context, b []byte) (m interface{}, err error) {
+	stop := armDeadline(ctx, c.conn.SetReadDeadline)
+	defer stop()
+	m, err = c.Recv(b)
+	return m, ctxErr(ctx, err)
+}
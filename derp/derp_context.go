@@ -0,0 +1,70 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pastDeadline is a time in the past, used to force a blocked Read or
+// Write to return immediately once a context is canceled.
+var pastDeadline = time.Unix(0, 1)
+
+// armDeadline applies ctx's deadline (if any) to a connection via
+// setDeadline, and starts a goroutine that forces setDeadline into the
+// past the instant ctx is done, unblocking any Read or Write already in
+// flight. The caller must call the returned stop func once its I/O call
+// has returned, which also clears the deadline.
+func armDeadline(ctx context.Context, setDeadline func(time.Time) error) (stop func()) {
+	if dl, ok := ctx.Deadline(); ok {
+		setDeadline(dl)
+	}
+	done := make(chan struct{})
+
+	// mu serializes the goroutine's "ctx is done, force the deadline
+	// into the past" write against stop's own cleanup, so that however
+	// the two race, stop's clearing of the deadline is never clobbered
+	// by a late setDeadline(pastDeadline): stop only ever proceeds to
+	// its own setDeadline call after the goroutine has either observed
+	// stopped==true (and done nothing) or already finished its write
+	// while holding mu.
+	var mu sync.Mutex
+	stopped := false
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !stopped {
+				setDeadline(pastDeadline)
+			}
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+	return func() {
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		close(done)
+		setDeadline(time.Time{})
+	}
+}
+
+// ctxErr returns ctx.Err() if ctx was canceled or its deadline exceeded,
+// so that an I/O error caused by armDeadline forcing a connection closed
+// is reported to the caller as a context error rather than a confusing
+// low-level timeout.
+func ctxErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,349 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"tailscale.com/types/key"
+)
+
+// This file implements an optional, in-band handshake that layers
+// authenticated encryption on top of the plain DERP frame stream,
+// independent of whatever transport security (if any) wraps the
+// underlying net.Conn. It's modeled on the station-to-station-style
+// "secret connection" handshake used by Tendermint: both sides exchange
+// ephemeral curve25519 keys, mix them into a transcript challenge, and
+// each proves ownership of its long-term key by signing that challenge.
+// That binds the ephemeral session to whichever long-term identity was
+// presented during the handshake, giving the session forward secrecy
+// and tamper-evidence: an on-path attacker who can't forge a signature
+// can't inject, modify, or replay frames into an established session.
+//
+// It does NOT by itself defeat a MITM on first contact. Both sides'
+// long-term identities (frameServerKey, frameClientInfo) are exchanged
+// in-band over the same channel the handshake is trying to protect,
+// with nothing tying either one to a previously-known-good value; an
+// attacker who can intercept the raw bytes can run two independently
+// "valid" encrypted sessions, one impersonating each side to the other.
+// Callers that need MITM resistance must pin the peer's key themselves
+// — e.g. a Client can compare ServerPublicKey/ServerSigningKey against
+// an expected value learned out-of-band before trusting the session.
+//
+// It's entirely opt-in: Client.EnableEncryption and
+// Server.RequireEncryption must both be used for a given connection to
+// be encrypted, and neither touches a connection until explicitly asked
+// to, so it can be rolled out gradually.
+
+const (
+	ephemeralKeyLen = keyLen // curve25519 public key
+	sigLen          = 64     // ed25519.SignatureSize
+
+	nonceLen     = 8                                        // monotonic counter, zero-extended into the AEAD nonce
+	sealOverhead = nonceLen + 1 + chacha20poly1305.Overhead // nonce + inner frame type + AEAD tag
+)
+
+// frameCipher holds the per-direction symmetric state installed after a
+// successful noise-style handshake.
+type frameCipher struct {
+	sendAEAD cipher.AEAD
+	recvAEAD cipher.AEAD
+
+	sendNonce uint64 // next nonce this side will send
+	recvNonce uint64 // next nonce expected from the peer
+}
+
+// aeadNonce expands a 64-bit counter into the 12-byte nonce
+// chacha20poly1305 expects.
+func aeadNonce(counter uint64) []byte {
+	var n [chacha20poly1305.NonceSize]byte
+	binary.BigEndian.PutUint64(n[chacha20poly1305.NonceSize-nonceLen:], counter)
+	return n[:]
+}
+
+// seal authenticates and encrypts an inner frame of type t with payload
+// bufs, returning nonce||ciphertext ready to go in a frameSealed frame.
+func (fc *frameCipher) seal(t frameType, bufs ...[]byte) []byte {
+	plain := make([]byte, 1, 1+sumLen(bufs))
+	plain[0] = byte(t)
+	for _, b := range bufs {
+		plain = append(plain, b...)
+	}
+	out := make([]byte, nonceLen, nonceLen+len(plain)+chacha20poly1305.Overhead)
+	binary.BigEndian.PutUint64(out, fc.sendNonce)
+	out = fc.sendAEAD.Seal(out, aeadNonce(fc.sendNonce), plain, nil)
+	fc.sendNonce++
+	return out
+}
+
+// open verifies and decrypts a frameSealed payload, returning the inner
+// frame type and plaintext. It rejects any nonce other than the next one
+// it expects, refusing out-of-order or replayed frames even though TCP
+// itself is already ordered and reliable.
+func (fc *frameCipher) open(sealed []byte) (frameType, []byte, error) {
+	if len(sealed) < nonceLen {
+		return 0, nil, fmt.Errorf("derp: sealed frame too short")
+	}
+	nonce := binary.BigEndian.Uint64(sealed[:nonceLen])
+	if nonce != fc.recvNonce {
+		return 0, nil, fmt.Errorf("derp: out-of-order or replayed nonce %d, want %d", nonce, fc.recvNonce)
+	}
+	plain, err := fc.recvAEAD.Open(nil, aeadNonce(nonce), sealed[nonceLen:], nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("derp: decrypting frame: %w", err)
+	}
+	if len(plain) < 1 {
+		return 0, nil, fmt.Errorf("derp: empty sealed frame")
+	}
+	fc.recvNonce++
+	return frameType(plain[0]), plain[1:], nil
+}
+
+func sumLen(bufs [][]byte) int {
+	var n int
+	for _, b := range bufs {
+		n += len(b)
+	}
+	return n
+}
+
+// handshakeChallenge derives the challenge both sides sign, binding the
+// session to exactly this pair of ephemeral keys regardless of who
+// initiated.
+func handshakeChallenge(aPub, bPub key.Public) [32]byte {
+	lo, hi := aPub, bPub
+	if bytes.Compare(lo[:], hi[:]) > 0 {
+		lo, hi = hi, lo
+	}
+	h := sha256.New()
+	h.Write(lo[:])
+	h.Write(hi[:])
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// deriveFrameCipher turns an X25519 shared secret plus both ephemeral
+// public keys into a pair of ChaCha20-Poly1305 ciphers, one per
+// direction, ordered by lexicographic comparison of the ephemeral
+// public keys so both ends agree on which key encrypts which direction
+// without needing to negotiate it. Salting the HKDF with the handshake
+// transcript (rather than just the shared secret) binds the derived
+// keys to this exact pair of ephemeral keys.
+func deriveFrameCipher(shared [32]byte, selfEph, peerEph key.Public, selfIsLower bool) (*frameCipher, error) {
+	salt := handshakeChallenge(selfEph, peerEph)
+	r := hkdf.New(sha256.New, shared[:], salt[:], []byte("tailscale derp encryption v1"))
+	var lowKey, highKey [chacha20poly1305.KeySize]byte
+	if _, err := io.ReadFull(r, lowKey[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, highKey[:]); err != nil {
+		return nil, err
+	}
+	sendKey, recvKey := highKey, lowKey
+	if selfIsLower {
+		sendKey, recvKey = lowKey, highKey
+	}
+	sendAEAD, err := chacha20poly1305.New(sendKey[:])
+	if err != nil {
+		return nil, err
+	}
+	recvAEAD, err := chacha20poly1305.New(recvKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return &frameCipher{sendAEAD: sendAEAD, recvAEAD: recvAEAD}, nil
+}
+
+// isLower reports whether a sorts before b, used to assign encryption
+// keys consistently between the two ends of the handshake.
+func isLower(a, b key.Public) bool {
+	return bytes.Compare(a[:], b[:]) < 0
+}
+
+// readHandshakeHello reads a frameHandshakeHello frame from br,
+// returning the peer's ephemeral public key.
+func readHandshakeHello(br *bufio.Reader) (key.Public, error) {
+	var buf [ephemeralKeyLen]byte
+	t, n, err := readFrame(br, ephemeralKeyLen, buf[:])
+	if err != nil {
+		return key.Public{}, err
+	}
+	if t != frameHandshakeHello || n != ephemeralKeyLen {
+		return key.Public{}, fmt.Errorf("unexpected handshake hello frame (type %v, %d bytes)", t, n)
+	}
+	var pub key.Public
+	copy(pub[:], buf[:])
+	return pub, nil
+}
+
+// readHandshakeAuth reads a frameHandshakeAuth frame from br, returning
+// the peer's signature over the handshake challenge.
+func readHandshakeAuth(br *bufio.Reader) ([]byte, error) {
+	buf := make([]byte, sigLen)
+	t, n, err := readFrame(br, sigLen, buf)
+	if err != nil {
+		return nil, err
+	}
+	if t != frameHandshakeAuth || n != sigLen {
+		return nil, fmt.Errorf("unexpected handshake auth frame (type %v, %d bytes)", t, n)
+	}
+	return buf, nil
+}
+
+// writeFrame writes t/bufs as one frame to the server, transparently
+// sealing it if EnableEncryption succeeded earlier. Callers must hold
+// c.wmu.
+//
+// On error, it discards c.bw and replaces it with a fresh bufio.Writer
+// over the same conn. bufio.Writer has sticky-error semantics: once one
+// Write or Flush fails, every later call on that same Writer returns the
+// cached error without ever touching the conn again, and a deadline that
+// expired mid-write can leave an unsent frame tail sitting in the
+// buffer. Without resetting, a single timed-out write (e.g. from
+// SendContext) would permanently wedge every subsequent write on this
+// Client, not just the one that timed out.
+func (c *Client) writeFrame(t frameType, bufs ...[]byte) error {
+	var err error
+	if c.enc == nil {
+		err = writeFrame(c.bw, t, bufs...)
+	} else {
+		err = writeFrame(c.bw, frameSealed, c.enc.seal(t, bufs...))
+	}
+	if err != nil {
+		c.bw = bufio.NewWriterSize(c.conn, c.bw.Size())
+	}
+	return err
+}
+
+// readFrame reads one frame from the server into b, transparently
+// unsealing it if encryption is active, and returns its (inner, if
+// sealed) type.
+func (c *Client) readFrame(b []byte) (frameType, int, error) {
+	if c.enc == nil {
+		return readFrame(c.br, uint32(len(b)), b)
+	}
+	sealed := make([]byte, len(b)+sealOverhead)
+	t, n, err := readFrame(c.br, uint32(len(sealed)), sealed)
+	if err != nil {
+		return 0, 0, err
+	}
+	if t != frameSealed {
+		return 0, 0, fmt.Errorf("derp: received unsealed frame type %v after enabling encryption", t)
+	}
+	innerType, plain, err := c.enc.open(sealed[:n])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(plain) > len(b) {
+		return 0, 0, fmt.Errorf("derp: decrypted frame of %d bytes too large for %d byte buffer", len(plain), len(b))
+	}
+	copy(b, plain)
+	return innerType, len(plain), nil
+}
+
+// EnableEncryption performs the noise-style handshake described above
+// with the server c is connected to. On success, every subsequent frame
+// c sends or receives is sealed with ChaCha20-Poly1305.
+//
+// EnableEncryption must be called, if at all, immediately after
+// NewClient returns and before any other Client method, since the
+// handshake itself reads and writes frames off the wire; calling it
+// later would race with, or consume frames intended for, a concurrent
+// Recv loop.
+func (c *Client) EnableEncryption() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	selfEphPriv, err := key.NewPrivate()
+	if err != nil {
+		return fmt.Errorf("derp: generating ephemeral key: %w", err)
+	}
+	selfEphPub := selfEphPriv.Public()
+
+	if err := writeFrame(c.bw, frameHandshakeHello, selfEphPub[:]); err != nil {
+		return fmt.Errorf("derp: sending handshake hello: %w", err)
+	}
+	peerEphPub, err := readHandshakeHello(c.br)
+	if err != nil {
+		return fmt.Errorf("derp: reading server handshake hello: %w", err)
+	}
+
+	challenge := handshakeChallenge(selfEphPub, peerEphPub)
+	if err := writeFrame(c.bw, frameHandshakeAuth, c.privateKey.Sign(challenge[:])); err != nil {
+		return fmt.Errorf("derp: sending handshake auth: %w", err)
+	}
+	peerSig, err := readHandshakeAuth(c.br)
+	if err != nil {
+		return fmt.Errorf("derp: reading server handshake auth: %w", err)
+	}
+	if !c.serverSigningKey.Verify(challenge[:], peerSig) {
+		return errors.New("derp: server failed to prove ownership of its advertised key")
+	}
+
+	shared := selfEphPriv.SharedKey(peerEphPub)
+	fc, err := deriveFrameCipher(shared, selfEphPub, peerEphPub, isLower(selfEphPub, peerEphPub))
+	if err != nil {
+		return fmt.Errorf("derp: deriving session keys: %w", err)
+	}
+	c.enc = fc
+	return nil
+}
+
+// handshakeEncryption is the server side of the handshake EnableEncryption
+// drives from the client. On success it installs c.enc so every later
+// frame read from or written to c is sealed.
+func (s *Server) handshakeEncryption(c *sclient, br *bufio.Reader) error {
+	selfEphPriv, err := key.NewPrivate()
+	if err != nil {
+		return fmt.Errorf("generating ephemeral key: %w", err)
+	}
+	selfEphPub := selfEphPriv.Public()
+
+	peerEphPub, err := readHandshakeHello(br)
+	if err != nil {
+		return fmt.Errorf("reading client handshake hello: %w", err)
+	}
+
+	c.wmu.Lock()
+	err = writeFrame(c.bw, frameHandshakeHello, selfEphPub[:])
+	c.wmu.Unlock()
+	if err != nil {
+		return fmt.Errorf("sending handshake hello: %w", err)
+	}
+
+	challenge := handshakeChallenge(selfEphPub, peerEphPub)
+	peerSig, err := readHandshakeAuth(br)
+	if err != nil {
+		return fmt.Errorf("reading client handshake auth: %w", err)
+	}
+	if !c.signingKey.Verify(challenge[:], peerSig) {
+		return errors.New("client failed to prove ownership of its advertised key")
+	}
+
+	c.wmu.Lock()
+	err = writeFrame(c.bw, frameHandshakeAuth, s.privateKey.Sign(challenge[:]))
+	c.wmu.Unlock()
+	if err != nil {
+		return fmt.Errorf("sending handshake auth: %w", err)
+	}
+
+	shared := selfEphPriv.SharedKey(peerEphPub)
+	fc, err := deriveFrameCipher(shared, selfEphPub, peerEphPub, isLower(selfEphPub, peerEphPub))
+	if err != nil {
+		return fmt.Errorf("deriving session keys: %w", err)
+	}
+	c.enc = fc
+	return nil
+}
@@ -0,0 +1,494 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// Conn is the subset of net.Conn that derp.Server needs from a client
+// connection. It's satisfied by *net.TCPConn and by test doubles such as
+// nettest.Conn.
+type Conn interface {
+	net.Conn
+}
+
+// Server is a DERP server. It forwards packets between clients that
+// don't have a direct connection to each other, identified by their
+// public key.
+//
+// Two Servers can be connected to each other to extend the network, but
+// that's not implemented here.
+type Server struct {
+	privateKey       key.Private
+	publicKey        key.Public
+	signingPublicKey key.SigningPublic
+	logf             logger.Logf
+
+	// WriteTimeout bounds how long the server waits for a slow client's
+	// writer goroutine to flush a forwarded packet before giving up on
+	// it. If zero, a default of 2 seconds is used.
+	WriteTimeout time.Duration
+
+	// MaxQueuePackets, if non-zero, overrides the number of forwarded
+	// packets queued per destination client before the oldest queued
+	// packet is dropped to make room for a new one.
+	MaxQueuePackets int
+
+	// VerifyClientCert, if non-nil, is consulted by Serve for every TLS
+	// client certificate before the DERP handshake begins; see Serve.
+	VerifyClientCert func(*x509.Certificate) bool
+
+	curClients     expvar.Int
+	curHomeClients expvar.Int
+
+	// packetsDropped is the total number of forwarded packets dropped,
+	// across all destinations, because their destination's queue was
+	// full.
+	packetsDropped expvar.Int
+	// packetsDroppedByKey is packetsDropped broken down by the
+	// destination public key (as key.Public.String()) whose queue was
+	// full.
+	packetsDroppedByKey expvar.Map
+	// queueDepth is the total number of packets currently sitting in a
+	// per-destination queue, across all destinations.
+	queueDepth expvar.Int
+
+	mu                sync.Mutex
+	closed            bool
+	requireEncryption bool
+	clients           map[key.Public]*sclient
+}
+
+// defaultMaxQueuePackets is the per-destination outbound queue depth
+// used when Server.MaxQueuePackets is zero.
+const defaultMaxQueuePackets = 32
+
+// NewServer returns a new DERP server. It doesn't listen on its own; the
+// caller is responsible for accepting connections and passing them to
+// Accept.
+func NewServer(privateKey key.Private, logf logger.Logf) *Server {
+	s := &Server{
+		privateKey:       privateKey,
+		publicKey:        privateKey.Public(),
+		signingPublicKey: privateKey.SigningPublic(),
+		logf:             logf,
+		clients:          make(map[key.Public]*sclient),
+	}
+	s.packetsDroppedByKey.Init()
+	return s
+}
+
+func (s *Server) maxQueuePackets() int {
+	if s.MaxQueuePackets > 0 {
+		return s.MaxQueuePackets
+	}
+	return defaultMaxQueuePackets
+}
+
+// RequireEncryption controls whether clients must complete the
+// noise-style encryption handshake (see derp_noise.go) as part of
+// registering. It defaults to false so deployments can upgrade clients
+// before flipping it on. Changing it only affects connections accepted
+// afterward.
+func (s *Server) RequireEncryption(v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requireEncryption = v
+}
+
+func (s *Server) encryptionRequired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requireEncryption
+}
+
+// Close closes the server, disconnecting all currently-connected
+// clients.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for _, c := range s.clients {
+		c.nc.Close()
+	}
+	return nil
+}
+
+// sclient is the server's state for one accepted client connection.
+type sclient struct {
+	key        key.Public
+	signingKey key.SigningPublic // client's long-term Ed25519 identity, for the encryption handshake
+	nc         Conn
+
+	wmu sync.Mutex // guards writes to bw
+	bw  *bufio.Writer
+
+	// preferred reports whether this client has told us (via
+	// frameNotePreferred) that we're its home DERP server. Guarded by
+	// Server.mu.
+	preferred bool
+
+	// enc, once set during registration, seals every frame written to
+	// and unseals every frame read from this client. It's never
+	// reassigned afterward, so it's safe to read without a lock.
+	enc *frameCipher
+
+	// sendQueue holds packets forwarded to this client that are waiting
+	// to be written by sendLoop. Senders enqueue into it non-blockingly,
+	// so a client that isn't draining its socket only ever delays
+	// itself, never the sender. It's never closed, to avoid a send-on-
+	// closed-channel race with forwardPacket; sendLoop instead exits via
+	// done.
+	sendQueue chan queuedPacket
+	// dropped counts packets dropped for this client because sendQueue
+	// was full when they arrived.
+	dropped expvar.Int
+
+	// done is closed by Server.unregisterClient to tell sendLoop to stop.
+	done chan struct{}
+}
+
+// queuedPacket is a forwarded packet waiting in an sclient's sendQueue.
+type queuedPacket struct {
+	src      key.Public
+	contents []byte
+}
+
+// sendLoop writes packets enqueued for c until s tells it to stop via
+// c.done. It's the only goroutine that ever writes a forwarded packet to
+// c.nc, so one client blocking on a full write buffer can't delay any
+// other client.
+//
+// A write error (including a WriteTimeout against a client that isn't
+// draining its socket) can leave a partially-written frame on the wire:
+// resetting c.bw afterward (see writeFrame) stops that error from
+// wedging every later write, but it can't un-send the bytes that already
+// reached the peer, so the frame stream to c is now desynced regardless.
+// sendLoop therefore treats any write error as fatal to the connection,
+// closing c.nc and stopping itself, rather than logging and continuing
+// to feed more frames into an already-corrupted stream.
+func (c *sclient) sendLoop(s *Server) {
+	for {
+		select {
+		case pkt := <-c.sendQueue:
+			s.queueDepth.Add(-1)
+			if err := c.sendPacket(pkt.src, pkt.contents, s.writeTimeout()); err != nil {
+				s.logf("derp: writing to %s: %v; closing connection", c.key, err)
+				c.nc.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// writeFrame writes t/bufs as one frame to c, transparently sealing it
+// if the encryption handshake completed during registration.
+//
+// On error, it discards c.bw and replaces it with a fresh bufio.Writer
+// over the same conn; see Client.writeFrame in derp_noise.go for why.
+// That keeps c.bw from returning a cached error forever, but a frame cut
+// off mid-write stays cut off on the wire, so sendLoop still treats any
+// write error as fatal and closes c's connection. Callers must hold
+// c.wmu.
+func (c *sclient) writeFrame(t frameType, bufs ...[]byte) error {
+	var err error
+	if c.enc == nil {
+		err = writeFrame(c.bw, t, bufs...)
+	} else {
+		err = writeFrame(c.bw, frameSealed, c.enc.seal(t, bufs...))
+	}
+	if err != nil {
+		c.bw = bufio.NewWriterSize(c.nc, c.bw.Size())
+	}
+	return err
+}
+
+// readFrame reads one frame sent by c into buf, transparently unsealing
+// it if encryption is active, and returns its (inner, if sealed) type.
+func (c *sclient) readFrame(br *bufio.Reader, buf []byte) (frameType, int, error) {
+	if c.enc == nil {
+		return readFrame(br, uint32(len(buf)), buf)
+	}
+	sealed := make([]byte, len(buf)+sealOverhead)
+	t, n, err := readFrame(br, uint32(len(sealed)), sealed)
+	if err != nil {
+		return 0, 0, err
+	}
+	if t != frameSealed {
+		return 0, 0, fmt.Errorf("derp: got unsealed frame type %v from %s after enabling encryption", t, c.key)
+	}
+	innerType, plain, err := c.enc.open(sealed[:n])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(plain) > len(buf) {
+		return 0, 0, fmt.Errorf("derp: decrypted frame of %d bytes too large for %d byte buffer", len(plain), len(buf))
+	}
+	copy(buf, plain)
+	return innerType, len(plain), nil
+}
+
+// sendControlResp replies to a frameControlReq with the given request id
+// with a frameControlResp carrying payload. See Client.Call.
+func (c *sclient) sendControlResp(id uint64, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var idBuf [callIDLen]byte
+	binary.BigEndian.PutUint64(idBuf[:], id)
+	return c.writeFrame(frameControlResp, idBuf[:], payload)
+}
+
+// sendPacket writes a forwarded packet to c, bounding the write by
+// timeout (zero means no deadline) so one slow client can't block its
+// own sendLoop goroutine forever.
+func (c *sclient) sendPacket(src key.Public, contents []byte, timeout time.Duration) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if timeout > 0 {
+		c.nc.SetWriteDeadline(time.Now().Add(timeout))
+		defer c.nc.SetWriteDeadline(time.Time{})
+	}
+	return c.writeFrame(frameRecvPacket, src[:], contents)
+}
+
+// Accept adds a new connection to the server and serves it until the
+// client disconnects, the connection errors, or the server is closed.
+// The caller is responsible for closing nc once Accept returns. The
+// server also closes nc itself on Close, when a newer connection for the
+// same key displaces it, and when writing a forwarded packet to it fails.
+func (s *Server) Accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string) {
+	s.AcceptContext(context.Background(), nc, brw, remoteAddr)
+}
+
+// AcceptContext is like Accept, but also returns as soon as ctx is
+// canceled, rather than only on a connection error, a client
+// disconnect, or Server.Close. Canceling ctx forces any in-flight read
+// from nc, including one during the initial handshake, to unblock by
+// moving nc's read deadline into the past; it doesn't close nc.
+func (s *Server) AcceptContext(ctx context.Context, nc Conn, brw *bufio.ReadWriter, remoteAddr string) {
+	stop := armDeadline(ctx, nc.SetReadDeadline)
+	defer stop()
+
+	c, err := s.registerClient(nc, brw, remoteAddr)
+	if err != nil {
+		s.logf("derp: %s: %v", remoteAddr, err)
+		return
+	}
+	defer s.unregisterClient(c)
+
+	buf := make([]byte, MaxPacketSize+keyLen)
+	for {
+		t, n, err := c.readFrame(brw.Reader, buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return
+			}
+			s.logf("derp: %s: %v", remoteAddr, err)
+			return
+		}
+		// A failure to act on a frame (e.g. a malformed payload)
+		// doesn't tear down this connection; it only affects that one
+		// frame. Only a failure to read the next frame from c itself
+		// is fatal. Forwarding to a slow destination no longer risks
+		// this at all: forwardPacket only enqueues.
+		if err := s.handleFrame(c, t, buf[:n]); err != nil {
+			s.logf("derp: %s: %v", remoteAddr, err)
+		}
+	}
+}
+
+func (s *Server) registerClient(nc Conn, brw *bufio.ReadWriter, remoteAddr string) (*sclient, error) {
+	if err := writeFrame(brw.Writer, frameServerKey, s.publicKey[:], s.signingPublicKey[:]); err != nil {
+		return nil, fmt.Errorf("sending server key: %w", err)
+	}
+
+	buf := make([]byte, 2*keyLen)
+	t, n, err := readFrame(brw.Reader, uint32(len(buf)), buf)
+	if err != nil {
+		return nil, fmt.Errorf("reading client key: %w", err)
+	}
+	if t != frameClientInfo || n != len(buf) {
+		return nil, fmt.Errorf("unexpected client info frame (type %v, %d bytes)", t, n)
+	}
+	var pub key.Public
+	var signingPub key.SigningPublic
+	copy(pub[:], buf[:keyLen])
+	copy(signingPub[:], buf[keyLen:])
+
+	c := &sclient{
+		key:        pub,
+		signingKey: signingPub,
+		nc:         nc,
+		bw:         brw.Writer,
+		sendQueue:  make(chan queuedPacket, s.maxQueuePackets()),
+		done:       make(chan struct{}),
+	}
+
+	if s.encryptionRequired() {
+		if err := s.handshakeEncryption(c, brw.Reader); err != nil {
+			return nil, fmt.Errorf("encryption handshake with %s: %w", remoteAddr, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("server closed")
+	}
+	if old, dup := s.clients[pub]; dup {
+		// A new connection for an already-connected key displaces the
+		// old one, same as the real server does for reconnecting
+		// clients.
+		delete(s.clients, pub)
+		old.nc.Close()
+	} else {
+		s.curClients.Add(1)
+	}
+	s.clients[pub] = c
+	go c.sendLoop(s)
+	return c, nil
+}
+
+func (s *Server) unregisterClient(c *sclient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.clients[c.key]
+	if !ok || cur != c {
+		return
+	}
+	delete(s.clients, c.key)
+	s.curClients.Add(-1)
+	if c.preferred {
+		s.curHomeClients.Add(-1)
+	}
+	close(c.done)
+}
+
+// handleFrame acts on a single already-read frame of type t from c.
+func (s *Server) handleFrame(c *sclient, t frameType, b []byte) error {
+	switch t {
+	case frameSendPacket:
+		if len(b) < keyLen {
+			return fmt.Errorf("short send-packet frame (%d bytes)", len(b))
+		}
+		var dst key.Public
+		copy(dst[:], b[:keyLen])
+		return s.forwardPacket(c.key, dst, b[keyLen:])
+	case frameNotePreferred:
+		if len(b) < 1 {
+			return fmt.Errorf("short note-preferred frame")
+		}
+		s.notePreferred(c, b[0] != 0)
+	case frameKeepAlive:
+		// No-op; the client is just telling us it's alive.
+	case frameControlReq:
+		if len(b) < callIDLen+1 {
+			return fmt.Errorf("short control-request frame (%d bytes)", len(b))
+		}
+		id := binary.BigEndian.Uint64(b[:callIDLen])
+		// The wrapped frameType (b[callIDLen]) identifies what kind of
+		// call this is; today every kind gets the same reply, an echo
+		// of its payload, which is enough to prove liveness (a Ping).
+		// Request-specific handling can dispatch on it here as more
+		// call kinds are added.
+		payload := b[callIDLen+1:]
+		return c.sendControlResp(id, payload)
+	default:
+		// Ignore unknown frame types for forward compatibility.
+	}
+	return nil
+}
+
+func (s *Server) notePreferred(c *sclient, preferred bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.preferred == preferred {
+		return
+	}
+	c.preferred = preferred
+	if preferred {
+		s.curHomeClients.Add(1)
+	} else {
+		s.curHomeClients.Add(-1)
+	}
+}
+
+// forwardPacket delivers contents, sent by src, to dst. It's a no-op if
+// dst isn't currently connected.
+//
+// forwardPacket runs on src's own Accept goroutine, but it never writes
+// to dst's connection directly: it only enqueues onto dst's sendQueue,
+// which dst's own sendLoop goroutine drains. So a dst that isn't
+// draining its socket only ever backs up its own queue — src's ability
+// to read its next frame, and to forward to any other destination, is
+// unaffected. If dst's queue is already full, the oldest queued packet
+// is dropped to make room, so one stuck destination degrades to bounded
+// packet loss for itself rather than server-wide backpressure.
+func (s *Server) forwardPacket(src, dst key.Public, contents []byte) error {
+	s.mu.Lock()
+	dstClient, ok := s.clients[dst]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	// contents aliases the Accept loop's read buffer, which is reused on
+	// the next iteration, so it must be copied before it can outlive
+	// this call by sitting in dstClient.sendQueue.
+	pkt := queuedPacket{src: src, contents: append([]byte(nil), contents...)}
+	select {
+	case dstClient.sendQueue <- pkt:
+		s.queueDepth.Add(1)
+		return nil
+	default:
+	}
+	// Queue full: drop the oldest queued packet to make room, then
+	// retry once. If sendLoop races us and drains a slot first, that's
+	// fine too; either way we only try twice rather than spin.
+	select {
+	case <-dstClient.sendQueue:
+		s.queueDepth.Add(-1)
+		s.notePacketDropped(dstClient, dst)
+	default:
+	}
+	select {
+	case dstClient.sendQueue <- pkt:
+		s.queueDepth.Add(1)
+	default:
+		s.notePacketDropped(dstClient, dst)
+	}
+	return nil
+}
+
+func (s *Server) notePacketDropped(dstClient *sclient, dst key.Public) {
+	dstClient.dropped.Add(1)
+	s.packetsDropped.Add(1)
+	s.packetsDroppedByKey.Add(dst.String(), 1)
+}
+
+func (s *Server) writeTimeout() time.Duration {
+	if s.WriteTimeout > 0 {
+		return s.WriteTimeout
+	}
+	return 2 * time.Second
+}
@@ -7,12 +7,19 @@ package derp
 import (
 	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"expvar"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -217,7 +224,12 @@ func TestSendFreeze(t *testing.T) {
 
 	var aliceCount, bobCount, cathyCount expvar.Int
 
-	errCh := make(chan error, 4)
+	errCh := make(chan error, 3)
+	// recvAndCount's consumer stops counting the moment it sees anything
+	// other than a ReceivedPacket, so cathy joining after bob must not
+	// cause bob to be told about it (the server doesn't broadcast peer
+	// presence/gone at all; see registerClient), or this loop would bail
+	// out before it ever observes a real alice->bob packet.
 	recvAndCount := func(count *expvar.Int, name string, client *Client) {
 		for {
 			b := make([]byte, 1<<9)
@@ -243,6 +255,13 @@ func TestSendFreeze(t *testing.T) {
 	go recvAndCount(&bobCount, "bob", bobClient)
 	go recvAndCount(&cathyCount, "cathy", cathyClient)
 
+	// senderErr reports the sender goroutine's own outcome, separately
+	// from errCh: once cathy's connection starts getting torn down
+	// below, cathy's own recvAndCount can push to errCh before the
+	// sender notices ctx was canceled, and cleanup needs to know
+	// specifically when the sender has stopped before it closes the
+	// connections out from under it.
+	senderErr := make(chan error, 1)
 	var cancel func()
 	go func() {
 		t := time.NewTicker(2 * time.Millisecond)
@@ -253,13 +272,13 @@ func TestSendFreeze(t *testing.T) {
 			select {
 			case <-t.C:
 			case <-ctx.Done():
-				errCh <- nil
+				senderErr <- nil
 				return
 			}
 
 			msg1 := []byte("hello alice->bob\n")
 			if err := aliceClient.Send(bobKey.Public(), msg1); err != nil {
-				errCh <- fmt.Errorf("alice send to bob: %w", err)
+				senderErr <- fmt.Errorf("alice send to bob: %w", err)
 				return
 			}
 			msg2 := []byte("hello alice->cathy\n")
@@ -306,20 +325,25 @@ func TestSendFreeze(t *testing.T) {
 
 	t.Run("block cathy", func(t *testing.T) {
 		// Block cathy. Now the cathyConn buffer will fill up quickly,
-		// and the derp server will back up.
+		// and cathy's queue on the server will start dropping packets.
 		cathyConn.SetReadBlock(true)
-		time.Sleep(2 * s.WriteTimeout)
 
+		// Forwarding to cathy only ever touches cathy's own queue and
+		// sendLoop goroutine, so alice->bob shouldn't be disturbed even
+		// well within a single WriteTimeout window, let alone the two
+		// full windows the old head-of-line-blocking design needed.
+		time.Sleep(s.WriteTimeout / 2)
 		a, b, _ := loadCounts()
 		if a != 0 {
 			t.Errorf("alice diff=%d, want 0", a)
 		}
 		if b == 0 {
-			t.Errorf("no bob diff, want positive value")
+			t.Errorf("connection alice->bob disturbed by alice->cathy stalling, within one WriteTimeout window")
 		}
 
-		// Now wait a little longer, and ensure packets still flow to bob
-		time.Sleep(10 * time.Millisecond)
+		// Now wait a lot longer, well past cathy's queue filling up and
+		// dropping, and confirm bob is still unaffected.
+		time.Sleep(2 * s.WriteTimeout)
 		if _, b, _ := loadCounts(); b == 0 {
 			t.Errorf("connection alice->bob frozen by alice->cathy")
 		}
@@ -328,6 +352,14 @@ func TestSendFreeze(t *testing.T) {
 	// Cleanup, make sure we process all errors.
 	t.Logf("TEST COMPLETE, cancelling sender")
 	cancel()
+	// Wait for the sender goroutine to actually stop before closing the
+	// connections out from under it: canceling ctx only asks it to stop
+	// at its next select, so a send already in flight could otherwise
+	// race an immediate Close and surface as a spurious closed-pipe
+	// error instead of the clean shutdown this is checking for.
+	if err := <-senderErr; err != nil {
+		t.Errorf("sender: %v", err)
+	}
 	t.Logf("closing connections")
 	aliceConn.Close()
 	bobConn.Close()
@@ -339,7 +371,293 @@ func TestSendFreeze(t *testing.T) {
 			if errors.Is(err, io.EOF) {
 				continue
 			}
+			// cathy's connection was deliberately wedged above: the
+			// server's sendLoop gave up on it mid-frame once a write to
+			// it timed out, so whatever partial frame already reached
+			// cathy's read buffer before the connection closed can
+			// surface as an unexpected EOF rather than a clean one.
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				continue
+			}
 			t.Error(err)
 		}
 	}
 }
+
+// TestClientContextCancel verifies that SendContext and RecvContext
+// unblock promptly when their context is canceled, rather than waiting
+// out whatever the server's WriteTimeout happens to be.
+func TestClientContextCancel(t *testing.T) {
+	serverPrivateKey := newPrivateKey(t)
+	s := NewServer(serverPrivateKey, t.Logf)
+	defer s.Close()
+	s.WriteTimeout = 10 * time.Second // would hang the test if ctx didn't win
+
+	selfKey := newPrivateKey(t)
+	c1, c2 := nettest.NewConn("client", 1024)
+	go s.Accept(c1, bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)), "client")
+
+	brw := bufio.NewReadWriter(bufio.NewReader(c2), bufio.NewWriter(c2))
+	client, err := NewClient(selfKey, c2, brw, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	// Recv has nothing to read; make sure canceling its context unblocks
+	// it quickly instead of hanging until the test times out.
+	ctx, cancel := context.WithCancel(context.Background())
+	recvDone := make(chan error, 1)
+	go func() {
+		_, err := client.RecvContext(ctx, make([]byte, 1<<10))
+		recvDone <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-recvDone:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("RecvContext error = %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("RecvContext did not return after context cancellation")
+	}
+
+	// Fill up the peer's send buffer so a Send blocks, then confirm
+	// SendContext with a short deadline gives up promptly once it passes.
+	// Filling uses SendContext too, each bounded by its own short
+	// deadline: once the pipe is actually full, a plain Send would block
+	// forever (nothing ever drains it, since c1.SetReadBlock(true) below
+	// stops the peer from reading), so only a context-bounded send can
+	// reliably break out of this loop.
+	otherKey := newPrivateKey(t)
+	c1.SetReadBlock(true)
+	defer c1.SetReadBlock(false)
+	for i := 0; i < 1000; i++ {
+		fillCtx, fillCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := client.SendContext(fillCtx, otherKey.Public(), []byte("fill the pipe"))
+		fillCancel()
+		if err != nil {
+			break
+		}
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel2()
+	if err := client.SendContext(ctx2, otherKey.Public(), []byte("hello")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SendContext error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// TestEncryptedSendRecv verifies that a Client which calls
+// EnableEncryption against a Server with RequireEncryption(true) can
+// still send and receive packets normally; the sealing/unsealing should
+// be entirely transparent above the Client/Server API.
+func TestEncryptedSendRecv(t *testing.T) {
+	serverPrivateKey := newPrivateKey(t)
+	s := NewServer(serverPrivateKey, t.Logf)
+	defer s.Close()
+	s.RequireEncryption(true)
+
+	newClient := func(name string, k key.Private) *Client {
+		t.Helper()
+		c1, c2 := nettest.NewConn(name, 1024)
+		go s.Accept(c1, bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)), name)
+
+		brw := bufio.NewReadWriter(bufio.NewReader(c2), bufio.NewWriter(c2))
+		c, err := NewClient(k, c2, brw, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.EnableEncryption(); err != nil {
+			t.Fatalf("%s: EnableEncryption: %v", name, err)
+		}
+		return c
+	}
+
+	aliceKey := newPrivateKey(t)
+	alice := newClient("alice", aliceKey)
+	bobKey := newPrivateKey(t)
+	bob := newClient("bob", bobKey)
+
+	msg := []byte("hello over an encrypted connection\n")
+	if err := alice.Send(bobKey.Public(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 1<<16)
+	m, err := bob.Recv(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, ok := m.(ReceivedPacket)
+	if !ok {
+		t.Fatalf("got message type %T, want ReceivedPacket", m)
+	}
+	if rp.Source != aliceKey.Public() {
+		t.Errorf("Source = %v, want %v", rp.Source, aliceKey.Public())
+	}
+	if got := string(rp.Data); got != string(msg) {
+		t.Errorf("Data = %q, want %q", got, string(msg))
+	}
+}
+
+// TestCall verifies that Client.Call round-trips a request/response pair
+// through the server without interfering with a concurrent Recv loop.
+func TestCall(t *testing.T) {
+	serverPrivateKey := newPrivateKey(t)
+	s := NewServer(serverPrivateKey, t.Logf)
+	defer s.Close()
+
+	c1, c2 := nettest.NewConn("client", 1024)
+	go s.Accept(c1, bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)), "client")
+
+	clientKey := newPrivateKey(t)
+	brw := bufio.NewReadWriter(bufio.NewReader(c2), bufio.NewWriter(c2))
+	client, err := NewClient(clientKey, c2, brw, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	// Call needs a concurrent Recv loop to read the response frame and
+	// dispatch it; a Client that's only ever calling Call would hang.
+	go func() {
+		for {
+			if _, err := client.Recv(make([]byte, 1<<10)); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	got, err := client.Call(ctx, frameKeepAlive, []byte("ping"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("Call reply = %q, want %q", got, "ping")
+	}
+
+	// Two concurrent Calls shouldn't cross-deliver each other's replies.
+	var wg sync.WaitGroup
+	for i, want := range []string{"alpha", "bravo"} {
+		i, want := i, want
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := client.Call(ctx, frameKeepAlive, []byte(want))
+			if err != nil {
+				t.Errorf("Call %d: %v", i, err)
+				return
+			}
+			if string(got) != want {
+				t.Errorf("Call %d reply = %q, want %q", i, got, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// selfSignedCert returns a freshly generated self-signed TLS certificate
+// for "localhost", for use as a test fixture.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+}
+
+// TestServeTLS verifies that Server.Serve and DialTLS can establish a
+// DERP connection over TLS, negotiating ALPNProto, and that packets then
+// flow exactly as they do over a plain connection.
+func TestServeTLS(t *testing.T) {
+	serverPrivateKey := newPrivateKey(t)
+	s := NewServer(serverPrivateKey, t.Logf)
+	defer s.Close()
+
+	cert := selfSignedCert(t)
+	serverTLSConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.Serve(ln, serverTLSConfig)
+
+	clientTLSConfig := &tls.Config{InsecureSkipVerify: true}
+	aliceKey := newPrivateKey(t)
+	alice, err := DialTLS(context.Background(), ln.Addr().String(), clientTLSConfig, aliceKey, t.Logf)
+	if err != nil {
+		t.Fatalf("alice: DialTLS: %v", err)
+	}
+	bobKey := newPrivateKey(t)
+	bob, err := DialTLS(context.Background(), ln.Addr().String(), clientTLSConfig, bobKey, t.Logf)
+	if err != nil {
+		t.Fatalf("bob: DialTLS: %v", err)
+	}
+
+	// DialTLS returning only means bob has written his frameClientInfo
+	// handshake frame; it's no guarantee the server has finished
+	// processing it and added bob to its clients map yet. A Send issued
+	// right away can race that registration and land first, in which
+	// case forwardPacket silently drops it (it's a no-op for an
+	// unregistered destination). So retry the send for a bit instead of
+	// assuming registration already happened by the time DialTLS returns.
+	recvCh := make(chan interface{}, 1)
+	recvErrCh := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1<<16)
+		m, err := bob.Recv(b)
+		if err != nil {
+			recvErrCh <- err
+			return
+		}
+		recvCh <- m
+	}()
+
+	msg := []byte("hello over TLS\n")
+	deadline := time.Now().Add(5 * time.Second)
+	var m interface{}
+waitForDelivery:
+	for {
+		if err := alice.Send(bobKey.Public(), msg); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m = <-recvCh:
+			break waitForDelivery
+		case err := <-recvErrCh:
+			t.Fatal(err)
+		case <-time.After(50 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("bob never received message; alice->bob registration race?")
+			}
+		}
+	}
+	rp, ok := m.(ReceivedPacket)
+	if !ok {
+		t.Fatalf("got message type %T, want ReceivedPacket", m)
+	}
+	if got := string(rp.Data); got != string(msg) {
+		t.Errorf("Data = %q, want %q", got, string(msg))
+	}
+}
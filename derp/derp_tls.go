@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// ALPNProto is the ALPN protocol name negotiated by Server.Serve and
+// DialTLS, so a DERP listener can share a port with other TLS
+// protocols (e.g. plain HTTPS) via ALPN-based routing.
+const ALPNProto = "tailscale-derp/1"
+
+// Serve accepts connections on ln, upgrades each to TLS using tlsConfig,
+// and runs the DERP protocol over it via Accept. It returns when ln.Accept
+// returns an error, typically because ln was closed.
+//
+// tlsConfig is cloned and ALPNProto is appended to its NextProtos if not
+// already present; a connection that doesn't negotiate ALPNProto is
+// rejected. If VerifyClientCert is set, it's consulted for every TLS
+// client certificate before the DERP handshake begins, so tlsConfig can
+// request client certificates (via ClientAuth) without having to trust
+// every certificate its own verification accepts.
+func (s *Server) Serve(ln net.Listener, tlsConfig *tls.Config) error {
+	tlsConfig = tlsConfig.Clone()
+	if !containsALPN(tlsConfig.NextProtos, ALPNProto) {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, ALPNProto)
+	}
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConnTLS(nc, tlsConfig)
+	}
+}
+
+func (s *Server) serveConnTLS(nc net.Conn, tlsConfig *tls.Config) {
+	remoteAddr := nc.RemoteAddr().String()
+	tc := tls.Server(nc, tlsConfig)
+	if err := tc.HandshakeContext(context.Background()); err != nil {
+		s.logf("derp: %s: TLS handshake: %v", remoteAddr, err)
+		nc.Close()
+		return
+	}
+	defer tc.Close()
+
+	cs := tc.ConnectionState()
+	if cs.NegotiatedProtocol != ALPNProto {
+		s.logf("derp: %s: client negotiated ALPN protocol %q, want %q", remoteAddr, cs.NegotiatedProtocol, ALPNProto)
+		return
+	}
+	if s.VerifyClientCert != nil {
+		if len(cs.PeerCertificates) == 0 || !s.VerifyClientCert(cs.PeerCertificates[0]) {
+			s.logf("derp: %s: client certificate rejected", remoteAddr)
+			return
+		}
+	}
+
+	brw := bufio.NewReadWriter(bufio.NewReader(tc), bufio.NewWriter(tc))
+	s.Accept(tc, brw, remoteAddr)
+}
+
+// DialTLS dials addr, performs a TLS handshake negotiating ALPNProto, and
+// returns a Client using privateKey as its identity. tlsConfig is cloned
+// and ALPNProto is appended to its NextProtos if not already present.
+func DialTLS(ctx context.Context, addr string, tlsConfig *tls.Config, privateKey key.Private, logf logger.Logf) (*Client, error) {
+	tlsConfig = tlsConfig.Clone()
+	if !containsALPN(tlsConfig.NextProtos, ALPNProto) {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, ALPNProto)
+	}
+
+	dialer := tls.Dialer{Config: tlsConfig}
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("derp: dialing %s: %w", addr, err)
+	}
+	tc := nc.(*tls.Conn)
+	if proto := tc.ConnectionState().NegotiatedProtocol; proto != ALPNProto {
+		tc.Close()
+		return nil, fmt.Errorf("derp: server negotiated ALPN protocol %q, want %q", proto, ALPNProto)
+	}
+
+	brw := bufio.NewReadWriter(bufio.NewReader(tc), bufio.NewWriter(tc))
+	c, err := NewClient(privateKey, tc, brw, logf)
+	if err != nil {
+		tc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func containsALPN(protos []string, want string) bool {
+	for _, p := range protos {
+		if p == want {
+			return true
+		}
+	}
+	return false
+}
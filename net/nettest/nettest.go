@@ -0,0 +1,187 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nettest contains additional utilities for testing, complementing
+// the standard library's net/nettest package.
+package nettest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conn is the interface implemented by the connections returned by NewConn.
+// In addition to net.Conn, it permits tests to simulate a peer that stops
+// draining its socket buffer.
+type Conn interface {
+	net.Conn
+
+	// SetReadBlock controls whether reads from this Conn block, as if
+	// the peer had stopped reading. A blocked read still returns once
+	// the Conn is closed or its read deadline passes.
+	SetReadBlock(block bool)
+}
+
+// NewConn returns a buffered, in-memory connection pair, named for
+// logging purposes. Each side buffers up to bufSize bytes of unread
+// writes from its peer; once that buffer is full, writes block (subject
+// to write deadlines) until the peer drains it, same as a real socket
+// with a bounded kernel buffer.
+func NewConn(name string, bufSize int) (c1, c2 Conn) {
+	p1 := &pipe{name: name + "-a", bufSize: bufSize}
+	p2 := &pipe{name: name + "-b", bufSize: bufSize}
+	p1.peer, p2.peer = p2, p1
+	p1.cond = sync.NewCond(&p1.mu)
+	p2.cond = sync.NewCond(&p2.mu)
+	return p1, p2
+}
+
+// pipe is one endpoint of a NewConn pair. Bytes written to pipe land in
+// the peer's buf; reads from pipe drain its own buf.
+type pipe struct {
+	name    string
+	bufSize int
+	peer    *pipe
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	buf           bytes.Buffer
+	closed        bool
+	readBlk       bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func deadlineExceeded(d time.Time) bool {
+	return !d.IsZero() && !time.Now().Before(d)
+}
+
+// waitLocked waits on p.cond until woken, up to deadline (the zero Time
+// means wait forever). p.mu must be held. It arms a timer so a pending
+// Wait is woken even if nobody else calls Broadcast.
+func (p *pipe) waitLocked(deadline time.Time) {
+	if deadline.IsZero() {
+		p.cond.Wait()
+		return
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return
+	}
+	timer := time.AfterFunc(d, func() {
+		p.mu.Lock()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	})
+	defer timer.Stop()
+	p.cond.Wait()
+}
+
+func (p *pipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.closed && (p.readBlk || p.buf.Len() == 0) {
+		if deadlineExceeded(p.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		p.waitLocked(p.readDeadline)
+	}
+	if p.buf.Len() == 0 && p.closed {
+		return 0, io.EOF
+	}
+	return p.buf.Read(b)
+}
+
+func (p *pipe) Write(b []byte) (n int, err error) {
+	peer := p.peer
+	for n < len(b) {
+		peer.mu.Lock()
+		for !peer.closed && peer.buf.Len() >= peer.bufSize {
+			p.mu.Lock()
+			wd := p.writeDeadline
+			p.mu.Unlock()
+			if deadlineExceeded(wd) {
+				peer.mu.Unlock()
+				return n, os.ErrDeadlineExceeded
+			}
+			peer.waitLocked(wd)
+		}
+		if peer.closed {
+			peer.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		space := peer.bufSize - peer.buf.Len()
+		chunk := len(b) - n
+		if chunk > space {
+			chunk = space
+		}
+		peer.buf.Write(b[n : n+chunk])
+		peer.cond.Broadcast()
+		peer.mu.Unlock()
+		n += chunk
+	}
+	return n, nil
+}
+
+func (p *pipe) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	peer := p.peer
+	peer.mu.Lock()
+	peer.closed = true
+	peer.cond.Broadcast()
+	peer.mu.Unlock()
+	return nil
+}
+
+// SetReadBlock controls whether Read on p blocks, simulating a peer that
+// has stopped draining its receive buffer. A blocked Read still returns
+// once p is closed (draining whatever is buffered) or its read deadline
+// passes.
+func (p *pipe) SetReadBlock(block bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readBlk = block
+	p.cond.Broadcast()
+}
+
+func (p *pipe) LocalAddr() net.Addr  { return addr(p.name) }
+func (p *pipe) RemoteAddr() net.Addr { return addr(p.peer.name) }
+
+func (p *pipe) SetDeadline(t time.Time) error {
+	if err := p.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return p.SetWriteDeadline(t)
+}
+
+func (p *pipe) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.readDeadline = t
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *pipe) SetWriteDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.writeDeadline = t
+	p.mu.Unlock()
+	p.peer.mu.Lock()
+	p.peer.cond.Broadcast()
+	p.peer.mu.Unlock()
+	return nil
+}
+
+type addr string
+
+func (a addr) Network() string { return "nettest" }
+func (a addr) String() string  { return string(a) }
@@ -0,0 +1,130 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package key defines some types related to curve25519 keys.
+package key
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Public is a public key, used for DiscoKey, NodeKey, or MachineKey.
+type Public [32]byte
+
+// IsZero reports whether k is the zero value.
+func (k Public) IsZero() bool {
+	return k == Public{}
+}
+
+func (k Public) String() string {
+	return fmt.Sprintf("pubkey:%x", k[:])
+}
+
+// ShortString returns the Tailscale conventional debug representation
+// of a public key: the first six bytes in hex.
+func (k Public) ShortString() string {
+	return fmt.Sprintf("[%x]", k[:6])
+}
+
+// Private is a private key, used for DiscoKey, NodeKey, or MachineKey.
+type Private [32]byte
+
+// NewPrivate returns a new private key.
+func NewPrivate() (k Private, err error) {
+	if _, err := rand.Read(k[:]); err != nil {
+		return Private{}, err
+	}
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+	return k, nil
+}
+
+// IsZero reports whether k is the zero value.
+func (k Private) IsZero() bool {
+	return k == Private{}
+}
+
+// Public returns the public key for the given private key.
+func (k Private) Public() (pub Public) {
+	if k.IsZero() {
+		panic("can't take Public of zero Private")
+	}
+	curve25519.ScalarBaseMult((*[32]byte)(&pub), (*[32]byte)(&k))
+	return
+}
+
+// SharedKey returns the precomputed Diffie-Hellman shared key between
+// k and peer, suitable for use as a symmetric encryption key.
+func (k Private) SharedKey(peer Public) (shared [32]byte) {
+	apk := (*[32]byte)(&peer)
+	ask := (*[32]byte)(&k)
+	curve25519.ScalarMult(&shared, ask, apk)
+	return
+}
+
+// Equal reports whether k and other are the same private key.
+func (k Private) Equal(other Private) bool {
+	return subtle.ConstantTimeCompare(k[:], other[:]) == 1
+}
+
+// HexString returns the hex encoding of k.
+func (k Private) HexString() string {
+	return hex.EncodeToString(k[:])
+}
+
+// SigningPublic is the Ed25519 public key corresponding to the Ed25519
+// variant of a Private, as returned by Private.SigningPublic. It's
+// distinct from Public (the curve25519 Diffie-Hellman public key
+// derived from the same seed) since the two serve different purposes:
+// Public is used to agree on shared secrets, SigningPublic to verify
+// signatures.
+type SigningPublic [ed25519.PublicKeySize]byte
+
+// edSeed derives the Ed25519 seed used by SigningPublic and Sign from k,
+// rather than handing k's raw bytes to ed25519.NewKeyFromSeed directly.
+// k's bytes are also used, unclamped, as a curve25519 scalar (see Public
+// and SharedKey); reusing one secret across two different primitives is
+// exactly what crypto libraries warn against, so the seed is instead a
+// domain-separated hash of k, keeping the two derived keys
+// cryptographically independent even though they trace back to the same
+// underlying secret.
+func (k Private) edSeed() (seed [ed25519.SeedSize]byte) {
+	h := sha256.New()
+	h.Write([]byte("tailscale key.Private ed25519 seed v1"))
+	h.Write(k[:])
+	h.Sum(seed[:0])
+	return seed
+}
+
+// SigningPublic returns the Ed25519 public key for k. Use this together
+// with Sign to authenticate a message as coming from the holder of k,
+// independent of k's use as a Diffie-Hellman key via Public and
+// SharedKey.
+func (k Private) SigningPublic() (pub SigningPublic) {
+	seed := k.edSeed()
+	edPriv := ed25519.NewKeyFromSeed(seed[:])
+	copy(pub[:], edPriv[ed25519.SeedSize:])
+	return pub
+}
+
+// Sign signs msg using the Ed25519 variant of k, as returned by
+// SigningPublic.
+func (k Private) Sign(msg []byte) []byte {
+	seed := k.edSeed()
+	edPriv := ed25519.NewKeyFromSeed(seed[:])
+	return ed25519.Sign(edPriv, msg)
+}
+
+// Verify reports whether sig is a valid Ed25519 signature of msg by the
+// holder of the private key whose signing public key is pub.
+func (pub SigningPublic) Verify(msg, sig []byte) bool {
+	return ed25519.Verify(pub[:], msg, sig)
+}
@@ -0,0 +1,9 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logger defines a type for writing log messages.
+package logger
+
+// Logf is the basic Tailscale logger type: a printf-like func.
+type Logf func(format string, args ...interface{})